@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/handler"
+)
+
+const cursorPrefix = "cursor:"
+
+var orderType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Order",
+	Fields: graphql.Fields{
+		"orderID":      &graphql.Field{Type: graphql.Float},
+		"regionID":     &graphql.Field{Type: graphql.Float},
+		"typeID":       &graphql.Field{Type: graphql.Float},
+		"stationID":    &graphql.Field{Type: graphql.Float},
+		"isBuyOrder":   &graphql.Field{Type: graphql.Boolean},
+		"price":        &graphql.Field{Type: graphql.Float},
+		"volumeRemain": &graphql.Field{Type: graphql.Float},
+		"volumeTotal":  &graphql.Field{Type: graphql.Float},
+		"minVolume":    &graphql.Field{Type: graphql.Float},
+		"duration":     &graphql.Field{Type: graphql.Float},
+		"issued":       &graphql.Field{Type: graphql.String},
+		"range":        &graphql.Field{Type: graphql.String},
+	},
+})
+
+var orderEdgeType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "OrderEdge",
+	Fields: graphql.Fields{
+		"cursor": &graphql.Field{Type: graphql.String},
+		"node":   &graphql.Field{Type: orderType},
+	},
+})
+
+var pageInfoType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "PageInfo",
+	Fields: graphql.Fields{
+		"hasNextPage": &graphql.Field{Type: graphql.Boolean},
+		"endCursor":   &graphql.Field{Type: graphql.String},
+	},
+})
+
+var orderConnectionType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "OrderConnection",
+	Fields: graphql.Fields{
+		"edges":    &graphql.Field{Type: graphql.NewList(orderEdgeType)},
+		"pageInfo": &graphql.Field{Type: pageInfoType},
+	},
+})
+
+var ordersQueryField = &graphql.Field{
+	Type: orderConnectionType,
+	Args: graphql.FieldConfigArgument{
+		"regionID":   &graphql.ArgumentConfig{Type: graphql.Int},
+		"typeID":     &graphql.ArgumentConfig{Type: graphql.Int},
+		"isBuyOrder": &graphql.ArgumentConfig{Type: graphql.Boolean},
+		"stationID":  &graphql.ArgumentConfig{Type: graphql.Int},
+		"minPrice":   &graphql.ArgumentConfig{Type: graphql.Float},
+		"maxPrice":   &graphql.ArgumentConfig{Type: graphql.Float},
+		"minVolume":  &graphql.ArgumentConfig{Type: graphql.Int},
+		"sortBy":     &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: "issued"},
+		"sortDesc":   &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: true},
+		"first":      &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 100},
+		"after":      &graphql.ArgumentConfig{Type: graphql.String},
+	},
+	Resolve: resolveOrders,
+}
+
+var rootQuery = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Query",
+	Fields: graphql.Fields{
+		"orders": ordersQueryField,
+	},
+})
+
+var orderSchema graphql.Schema
+
+func init() {
+	var err error
+	orderSchema, err = graphql.NewSchema(graphql.SchemaConfig{Query: rootQuery})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// resolveOrders builds a filtered SQL query over the orders table from the
+// GraphQL args, then sorts and paginates the result in memory.
+func resolveOrders(p graphql.ResolveParams) (interface{}, error) {
+	query, args := ordersFilterQuery(p.Args)
+
+	orders, err := fetchOrders(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	sortOrdersBy(orders, p.Args["sortBy"].(string), p.Args["sortDesc"].(bool))
+
+	first, _ := p.Args["first"].(int)
+	after, _ := p.Args["after"].(string)
+	return paginateOrders(orders, first, after)
+}
+
+// ordersFilterQuery turns the orders(...) GraphQL args into a SELECT
+// against the orders table, filtering server-side rather than shipping
+// every row to the resolver.
+func ordersFilterQuery(gqlArgs map[string]interface{}) (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+
+	addClause := func(column, op string, value interface{}) {
+		args = append(args, value)
+		clauses = append(clauses, fmt.Sprintf(`%s %s $%d`, column, op, len(args)))
+	}
+
+	if regionID, ok := gqlArgs["regionID"].(int); ok {
+		addClause(`"regionID"`, "=", regionID)
+	}
+	if typeID, ok := gqlArgs["typeID"].(int); ok {
+		addClause(`"typeID"`, "=", typeID)
+	}
+	if isBuyOrder, ok := gqlArgs["isBuyOrder"].(bool); ok {
+		addClause(`"isBuyOrder"`, "=", isBuyOrder)
+	}
+	if stationID, ok := gqlArgs["stationID"].(int); ok {
+		addClause(`"stationID"`, "=", stationID)
+	}
+	if minPrice, ok := gqlArgs["minPrice"].(float64); ok {
+		addClause(`"price"`, ">=", minPrice)
+	}
+	if maxPrice, ok := gqlArgs["maxPrice"].(float64); ok {
+		addClause(`"price"`, "<=", maxPrice)
+	}
+	if minVolume, ok := gqlArgs["minVolume"].(int); ok {
+		addClause(`"volumeRemain"`, ">=", minVolume)
+	}
+
+	query := `SELECT ` + orderColumns + ` FROM "orders"`
+	if len(clauses) > 0 {
+		query += " WHERE " + strings.Join(clauses, " AND ")
+	}
+
+	return query, args
+}
+
+func sortOrdersBy(orders []Order, sortBy string, desc bool) {
+	less := func(i, j int) bool {
+		switch sortBy {
+		case "price":
+			return orders[i].Price < orders[j].Price
+		default:
+			return orders[i].Issued < orders[j].Issued
+		}
+	}
+
+	if desc {
+		sort.SliceStable(orders, func(i, j int) bool { return less(j, i) })
+	} else {
+		sort.SliceStable(orders, less)
+	}
+}
+
+// paginateOrders implements a simplified Relay-style cursor: the cursor is
+// the base64 encoding of cursorPrefix followed by the index of the order in
+// the filtered/sorted slice.
+func paginateOrders(orders []Order, first int, after string) (map[string]interface{}, error) {
+	start := 0
+	if after != "" {
+		index, err := decodeCursor(after)
+		if err != nil {
+			return nil, err
+		}
+		start = index + 1
+	}
+
+	if start > len(orders) {
+		start = len(orders)
+	}
+
+	// first == 0 must yield zero edges (Relay cursor semantics), so only
+	// a negative first (unset by callers; the schema default is 100)
+	// falls back to "no limit".
+	end := start + first
+	if first < 0 {
+		end = len(orders)
+	}
+	if end > len(orders) {
+		end = len(orders)
+	}
+
+	page := orders[start:end]
+	edges := make([]map[string]interface{}, len(page))
+	for i, order := range page {
+		edges[i] = map[string]interface{}{
+			"cursor": encodeCursor(start + i),
+			"node":   order,
+		}
+	}
+
+	pageInfo := map[string]interface{}{
+		"hasNextPage": end < len(orders),
+		"endCursor":   "",
+	}
+	if len(edges) > 0 {
+		pageInfo["endCursor"] = edges[len(edges)-1]["cursor"]
+	}
+
+	return map[string]interface{}{
+		"edges":    edges,
+		"pageInfo": pageInfo,
+	}, nil
+}
+
+func encodeCursor(index int) string {
+	return base64.StdEncoding.EncodeToString([]byte(cursorPrefix + strconv.Itoa(index)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	decoded, err := base64.StdEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	if !strings.HasPrefix(string(decoded), cursorPrefix) {
+		return 0, fmt.Errorf("invalid cursor: %q", cursor)
+	}
+
+	return strconv.Atoi(strings.TrimPrefix(string(decoded), cursorPrefix))
+}
+
+// newGraphQLHandler builds the HTTP handler serving the GraphQL API, with
+// the GraphiQL playground enabled only when requested.
+func newGraphQLHandler(withPlayground bool) gin.HandlerFunc {
+	h := handler.New(&handler.Config{
+		Schema:   &orderSchema,
+		Pretty:   true,
+		GraphiQL: withPlayground,
+	})
+
+	return gin.WrapH(h)
+}
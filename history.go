@@ -0,0 +1,402 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// historyRingSize covers a full day of hourly buckets; older hours are
+// overwritten in place as the ring wraps.
+const historyRingSize = 24
+
+// Aggregate summarizes a set of orders on one side (buy or sell) of a book.
+type Aggregate struct {
+	MinPrice    float64
+	MaxPrice    float64
+	AvgPrice    float64
+	MedianPrice float64
+	TotalVolume int64
+	OrderCount  int64
+}
+
+// HistoryPoint is one bucket of the history series returned by getHistory,
+// for either a persisted day rollup or a transient in-memory hour bucket.
+type HistoryPoint struct {
+	Timestamp   string  `json:"timestamp"`
+	IsBuyOrder  bool    `json:"isBuyOrder"`
+	MinPrice    float64 `json:"minPrice"`
+	MaxPrice    float64 `json:"maxPrice"`
+	AvgPrice    float64 `json:"avgPrice"`
+	MedianPrice float64 `json:"medianPrice"`
+	TotalVolume int64   `json:"totalVolume"`
+	OrderCount  int64   `json:"orderCount"`
+}
+
+func computeAggregate(orders []Order, isBuyOrder bool) Aggregate {
+	var prices []float64
+	var totalVolume int64
+	for _, order := range orders {
+		if order.IsBuyOrder != isBuyOrder {
+			continue
+		}
+		prices = append(prices, order.Price)
+		totalVolume += order.VolumeRemain
+	}
+
+	if len(prices) == 0 {
+		return Aggregate{}
+	}
+
+	sort.Float64s(prices)
+
+	var sum float64
+	for _, price := range prices {
+		sum += price
+	}
+
+	median := prices[len(prices)/2]
+	if len(prices)%2 == 0 {
+		median = (prices[len(prices)/2-1] + prices[len(prices)/2]) / 2
+	}
+
+	return Aggregate{
+		MinPrice:    prices[0],
+		MaxPrice:    prices[len(prices)-1],
+		AvgPrice:    sum / float64(len(prices)),
+		MedianPrice: median,
+		TotalVolume: totalVolume,
+		OrderCount:  int64(len(prices)),
+	}
+}
+
+type historyKey struct {
+	regionID int64
+	typeID   int64
+}
+
+type hourBucket struct {
+	hour time.Time
+	buy  Aggregate
+	sell Aggregate
+	set  bool
+}
+
+// historyTracker keeps a per-(regionID, typeID) ring of hourly aggregates
+// in memory, computed from each snapshot handleMessage commits, so daily
+// rollups can be derived without re-reading anything from the database.
+type historyTracker struct {
+	mu      sync.Mutex
+	buckets map[historyKey]*[historyRingSize]hourBucket
+}
+
+var historyRing = &historyTracker{buckets: make(map[historyKey]*[historyRingSize]hourBucket)}
+
+// historyRollupJob is a day's worth of hourly buckets waiting to be
+// upserted into market_history by the background history worker.
+type historyRollupJob struct {
+	regionID int64
+	typeID   int64
+	day      time.Time
+	buckets  []hourBucket
+}
+
+// historyRollups is consumed by startHistoryWorker. It's buffered and fed
+// by a non-blocking send so a slow database never stalls the NSQ handler.
+var historyRollups = make(chan historyRollupJob, 256)
+
+// startHistoryWorker runs the background goroutine that persists day
+// rollups, keeping the (comparatively slow) upsert off the NSQ hot path.
+func startHistoryWorker() {
+	go func() {
+		for job := range historyRollups {
+			err := upsertMarketHistory(job.regionID, job.typeID, job.day, job.buckets)
+			if err != nil {
+				logrus.Warnf("Error upserting market history for region %d, type %d: %s", job.regionID, job.typeID, err.Error())
+			}
+		}
+	}()
+}
+
+// record folds a snapshot's orders into the current hour's bucket and
+// queues the owning day's rollup for the background history worker to
+// upsert into market_history.
+func (t *historyTracker) record(regionID, typeID int64, at time.Time, orders []Order) {
+	hour := at.Truncate(time.Hour)
+	key := historyKey{regionID, typeID}
+
+	t.mu.Lock()
+	ring, ok := t.buckets[key]
+	if !ok {
+		ring = &[historyRingSize]hourBucket{}
+		t.buckets[key] = ring
+	}
+	ring[hour.Hour()%historyRingSize] = hourBucket{
+		hour: hour,
+		buy:  computeAggregate(orders, true),
+		sell: computeAggregate(orders, false),
+		set:  true,
+	}
+
+	var dayBuckets []hourBucket
+	for _, bucket := range ring {
+		if bucket.set && sameDay(bucket.hour, hour) {
+			dayBuckets = append(dayBuckets, bucket)
+		}
+	}
+	t.mu.Unlock()
+
+	year, month, dayOfMonth := hour.Date()
+	day := time.Date(year, month, dayOfMonth, 0, 0, 0, 0, hour.Location())
+	job := historyRollupJob{regionID: regionID, typeID: typeID, day: day, buckets: dayBuckets}
+	select {
+	case historyRollups <- job:
+	default:
+		logrus.Warnf("Dropping market history rollup for region %d, type %d: worker backlog full", regionID, typeID)
+	}
+}
+
+// hourly returns the ring's hourly buckets for the most recently recorded
+// day for a key, oldest first. The ring is indexed by hour-of-day, so once
+// it's wrapped past midnight it can hold a mix of yesterday's and today's
+// buckets (or, for slow-moving keys, buckets several days stale); fixing
+// on the latest recorded hour's calendar day keeps the result to a single
+// coherent day instead of a cross-day splice.
+func (t *historyTracker) hourly(regionID, typeID int64) []HistoryPoint {
+	t.mu.Lock()
+	ring, ok := t.buckets[historyKey{regionID, typeID}]
+	var snapshot [historyRingSize]hourBucket
+	if ok {
+		snapshot = *ring
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		return []HistoryPoint{}
+	}
+
+	var latest time.Time
+	for _, bucket := range snapshot {
+		if bucket.set && bucket.hour.After(latest) {
+			latest = bucket.hour
+		}
+	}
+
+	points := []HistoryPoint{}
+	for _, bucket := range snapshot {
+		if !bucket.set || !sameDay(bucket.hour, latest) {
+			continue
+		}
+		if bucket.buy.OrderCount > 0 {
+			points = append(points, newHistoryPoint(bucket.hour, true, bucket.buy))
+		}
+		if bucket.sell.OrderCount > 0 {
+			points = append(points, newHistoryPoint(bucket.hour, false, bucket.sell))
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool { return points[i].Timestamp < points[j].Timestamp })
+	return points
+}
+
+func newHistoryPoint(ts time.Time, isBuyOrder bool, agg Aggregate) HistoryPoint {
+	return HistoryPoint{
+		Timestamp:   ts.Format(time.RFC3339),
+		IsBuyOrder:  isBuyOrder,
+		MinPrice:    agg.MinPrice,
+		MaxPrice:    agg.MaxPrice,
+		AvgPrice:    agg.AvgPrice,
+		MedianPrice: agg.MedianPrice,
+		TotalVolume: agg.TotalVolume,
+		OrderCount:  agg.OrderCount,
+	}
+}
+
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
+
+// mergeAggregates combines a day's worth of hourly aggregates for one side
+// of the book. The merged median is a count-weighted average of the hourly
+// medians, since raw prices aren't kept once their hour bucket is merged.
+func mergeAggregates(buckets []hourBucket, isBuyOrder bool) Aggregate {
+	var merged Aggregate
+	var weightedMedian float64
+	first := true
+
+	for _, bucket := range buckets {
+		side := bucket.sell
+		if isBuyOrder {
+			side = bucket.buy
+		}
+		if side.OrderCount == 0 {
+			continue
+		}
+
+		if first || side.MinPrice < merged.MinPrice {
+			merged.MinPrice = side.MinPrice
+		}
+		if first || side.MaxPrice > merged.MaxPrice {
+			merged.MaxPrice = side.MaxPrice
+		}
+
+		merged.AvgPrice = (merged.AvgPrice*float64(merged.OrderCount) + side.AvgPrice*float64(side.OrderCount)) / float64(merged.OrderCount+side.OrderCount)
+		weightedMedian += side.MedianPrice * float64(side.OrderCount)
+		merged.TotalVolume += side.TotalVolume
+		merged.OrderCount += side.OrderCount
+		first = false
+	}
+
+	if merged.OrderCount > 0 {
+		merged.MedianPrice = weightedMedian / float64(merged.OrderCount)
+	}
+
+	return merged
+}
+
+// upsertMarketHistory rolls a day's hourly buckets up into market_history.
+func upsertMarketHistory(regionID, typeID int64, day time.Time, buckets []hourBucket) error {
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sides := []struct {
+		isBuyOrder bool
+		aggregate  Aggregate
+	}{
+		{true, mergeAggregates(buckets, true)},
+		{false, mergeAggregates(buckets, false)},
+	}
+
+	query := `
+		INSERT INTO "market_history" (
+			"regionID", "typeID", "day", "isBuyOrder",
+			"minPrice", "maxPrice", "avgPrice", "medianPrice", "totalVolume", "orderCount"
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT ("regionID", "typeID", "day", "isBuyOrder") DO UPDATE SET
+			"minPrice" = EXCLUDED."minPrice",
+			"maxPrice" = EXCLUDED."maxPrice",
+			"avgPrice" = EXCLUDED."avgPrice",
+			"medianPrice" = EXCLUDED."medianPrice",
+			"totalVolume" = EXCLUDED."totalVolume",
+			"orderCount" = EXCLUDED."orderCount"`
+
+	for _, side := range sides {
+		if side.aggregate.OrderCount == 0 {
+			continue
+		}
+
+		_, err := tx.Exec(query, regionID, typeID, day, side.isBuyOrder,
+			side.aggregate.MinPrice, side.aggregate.MaxPrice, side.aggregate.AvgPrice,
+			side.aggregate.MedianPrice, side.aggregate.TotalVolume, side.aggregate.OrderCount)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// startHistoryRetention periodically deletes market_history rows older
+// than retentionDays.
+func startHistoryRetention(retentionDays int) {
+	go func() {
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			cutoff := time.Now().AddDate(0, 0, -retentionDays)
+			result, err := db.Exec(`DELETE FROM "market_history" WHERE "day" < $1`, cutoff)
+			if err != nil {
+				logrus.Warnf("Error enforcing market history retention: %s", err.Error())
+				continue
+			}
+			if deleted, err := result.RowsAffected(); err == nil && deleted > 0 {
+				logrus.Debugf("Deleted %d market history rows older than %d days", deleted, retentionDays)
+			}
+		}
+	}()
+}
+
+// getHistory returns the aggregated price/volume history for a
+// (regionID, typeID) pair, bucketed by day (persisted rollups) or hour
+// (the in-memory ring, limited to the most recently recorded day).
+func getHistory(context *gin.Context) {
+	regionID, err := strconv.ParseInt(context.Param("regionID"), 10, 64)
+	if err != nil {
+		context.AbortWithError(400, err)
+		return
+	}
+
+	typeID, err := strconv.ParseInt(context.Param("typeID"), 10, 64)
+	if err != nil {
+		context.AbortWithError(400, err)
+		return
+	}
+
+	if context.DefaultQuery("bucket", "day") == "hour" {
+		context.Header("Access-Control-Allow-Origin", "*")
+		context.JSON(200, historyRing.hourly(regionID, typeID))
+		return
+	}
+
+	args := []interface{}{regionID, typeID}
+	query := `SELECT "day", "isBuyOrder", "minPrice", "maxPrice", "avgPrice", "medianPrice", "totalVolume", "orderCount"
+		FROM "market_history" WHERE "regionID" = $1 AND "typeID" = $2`
+
+	if from := context.Query("from"); from != "" {
+		args = append(args, from)
+		query += ` AND "day" >= $` + strconv.Itoa(len(args))
+	}
+	if to := context.Query("to"); to != "" {
+		args = append(args, to)
+		query += ` AND "day" <= $` + strconv.Itoa(len(args))
+	}
+	query += ` ORDER BY "day" ASC`
+
+	points, err := fetchHistory(query, args...)
+	if err != nil {
+		context.AbortWithError(500, err)
+		return
+	}
+
+	context.Header("Access-Control-Allow-Origin", "*")
+	context.JSON(200, points)
+}
+
+func fetchHistory(query string, args ...interface{}) ([]HistoryPoint, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []HistoryPoint{}
+	for rows.Next() {
+		var day time.Time
+		var point HistoryPoint
+
+		err := rows.Scan(&day, &point.IsBuyOrder, &point.MinPrice, &point.MaxPrice,
+			&point.AvgPrice, &point.MedianPrice, &point.TotalVolume, &point.OrderCount)
+		if err != nil {
+			return nil, err
+		}
+
+		point.Timestamp = day.Format("2006-01-02")
+		points = append(points, point)
+	}
+
+	return points, rows.Err()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoryTrackerHourlyStaysWithinLatestDay(t *testing.T) {
+	tracker := &historyTracker{buckets: make(map[historyKey]*[historyRingSize]hourBucket)}
+	regionID, typeID := int64(10000002), int64(34)
+	order := []Order{{OrderID: 1, Price: 5.0, VolumeRemain: 100, IsBuyOrder: true}}
+
+	day1 := time.Date(2026, 7, 25, 0, 0, 0, 0, time.UTC)
+	for hour := 0; hour < 24; hour++ {
+		tracker.record(regionID, typeID, day1.Add(time.Duration(hour)*time.Hour), order)
+	}
+
+	day2 := time.Date(2026, 7, 26, 0, 0, 0, 0, time.UTC)
+	for hour := 0; hour < 6; hour++ {
+		tracker.record(regionID, typeID, day2.Add(time.Duration(hour)*time.Hour), order)
+	}
+
+	points := tracker.hourly(regionID, typeID)
+	if len(points) == 0 {
+		t.Fatal("expected hourly() to return points for the latest recorded day")
+	}
+
+	for _, point := range points {
+		ts, err := time.Parse(time.RFC3339, point.Timestamp)
+		if err != nil {
+			t.Fatalf("unexpected timestamp format %q: %s", point.Timestamp, err.Error())
+		}
+		if !sameDay(ts, day2) {
+			t.Errorf("hourly() returned a bucket from %s, want only buckets from %s", ts, day2)
+		}
+	}
+}
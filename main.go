@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"runtime"
+	"strings"
 	"time"
 
 	"database/sql"
@@ -11,9 +13,7 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/buger/jsonparser"
 	"github.com/gin-gonic/contrib/cors"
-	"github.com/gin-gonic/contrib/ginrus"
 	"github.com/gin-gonic/gin"
-	"github.com/golang/snappy"
 	"github.com/kelseyhightower/envconfig"
 	_ "github.com/lib/pq"
 	_ "github.com/mattes/migrate/driver/postgres"
@@ -23,10 +23,12 @@ import (
 
 // Config holds the application's configuration info from the environment.
 type Config struct {
-	LogLevel    string `default:"info" split_words:"true"`
-	PostgresURL string `default:"postgres://order-server@localhost:5432/order-server?sslmode=disable" envconfig:"postgres_url"`
-	NSQURL      string `default:"nsqd:4150" envconfig:"nsq_url"`
-	Port        string `default:"8000" envconfig:"port"`
+	LogLevel             string `default:"info" split_words:"true"`
+	PostgresURL          string `default:"postgres://order-server@localhost:5432/order-server?sslmode=disable" envconfig:"postgres_url"`
+	NSQURL               string `default:"nsqd:4150" envconfig:"nsq_url"`
+	Port                 string `default:"8000" envconfig:"port"`
+	Debug                bool   `default:"false" split_words:"true"`
+	HistoryRetentionDays int    `default:"365" split_words:"true"`
 }
 
 var db *sql.DB
@@ -36,6 +38,9 @@ func main() {
 	connectToDB(config)
 	migrateDB(config)
 	startNSQConsumer(config)
+	startReaper()
+	startHistoryWorker()
+	startHistoryRetention(config.HistoryRetentionDays)
 	startWebServer(config)
 
 	// Terminate this goroutine, crash if all other goroutines exited
@@ -85,35 +90,62 @@ func startNSQConsumer(config Config) {
 
 // Handle messages from NSQ
 func handleMessage(message *nsq.Message) error {
+	nsqMessagesReceived.Inc()
+	nsqMessagePayloadBytes.Observe(float64(len(message.Body)))
+
 	regionID, err := jsonparser.GetInt(message.Body, "regionID")
 	if err != nil {
 		logrus.Warnf("Error parsing regionID: %s", err.Error())
+		nsqMessagesFailed.Inc()
 		return err
 	}
 
 	typeID, err := jsonparser.GetInt(message.Body, "typeID")
 	if err != nil {
 		logrus.Warnf("Error parsing typeID: %s", err.Error())
+		nsqMessagesFailed.Inc()
 		return err
 	}
 
-	var compressedRowset []byte
-	compressedRowset = snappy.Encode(compressedRowset, message.Body)
+	orders, err := parseOrdersJSON(message.Body, regionID, typeID)
+	if err != nil {
+		logrus.Warnf("Error parsing orders for region %d, type %d: %s", regionID, typeID, err.Error())
+		nsqMessagesFailed.Inc()
+		return err
+	}
+	nsqMessagesDecoded.Inc()
 
-	query := `INSERT INTO markets ("regionID", "typeID", "market") VALUES ($1, $2, $3) ON CONFLICT ("regionID", "typeID") DO UPDATE SET "market" = EXCLUDED."market"`
+	txStart := time.Now()
 	tx, err := db.Begin()
 	if err != nil {
+		nsqMessagesFailed.Inc()
 		return err
 	}
-	_, err = tx.Exec(query, regionID, typeID, compressedRowset)
+
+	updatedAt := time.Now()
+	err = upsertOrders(tx, orders, updatedAt)
 	if err != nil {
+		tx.Rollback()
+		nsqMessagesFailed.Inc()
 		return err
 	}
 
 	err = tx.Commit()
 	if err != nil {
+		nsqMessagesFailed.Inc()
 		return err
 	}
+	dbTransactionDuration.WithLabelValues("insert").Observe(time.Since(txStart).Seconds())
+
+	snapshots.record(regionID, typeID, updatedAt)
+	historyRing.record(regionID, typeID, updatedAt, orders)
+
+	streamHub.publish(Event{
+		RegionID:   regionID,
+		TypeID:     typeID,
+		OrderCount: len(orders),
+		UpdatedAt:  updatedAt,
+	})
 
 	return nil
 }
@@ -123,12 +155,22 @@ func startWebServer(config Config) {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
 	router.Use(cors.Default())
-	router.Use(ginrus.Ginrus(logrus.StandardLogger(), time.RFC3339, true))
+	router.Use(instrumentedRequest())
+
+	router.GET("/metrics", metricsHandler())
 
 	v1 := router.Group("/api/orders/v1")
 	v1.GET("/region/:regionID/", getRegion)
 	v1.GET("/type/:typeID/", getType)
 	v1.GET("/region/:regionID/type/:typeID/", getRegionType)
+	v1.GET("/region/:regionID/type/:typeID/history", getHistory)
+	v1.GET("/stream", streamOrders)
+
+	graphqlHandler := newGraphQLHandler(config.Debug)
+	v1.Any("/graphql", graphqlHandler)
+	if config.Debug {
+		v1.GET("/playground", newGraphQLHandler(true))
+	}
 
 	router.Run(":" + config.Port)
 }
@@ -136,133 +178,90 @@ func startWebServer(config Config) {
 func getRegion(context *gin.Context) {
 	regionID := context.Param("regionID")
 
-	query := `SELECT "market" FROM "markets" WHERE "regionID" = $1`
-	tx, err := db.Begin()
-	if err != nil {
-		context.AbortWithError(500, err)
-		return
-	}
-
-	rows, err := tx.Query(query, regionID)
-	if err != nil {
-		context.AbortWithError(500, err)
-		return
-	}
-
-	response, err := concatRowsToJSON(rows)
-	if err != nil {
-		context.AbortWithError(404, err)
-		return
-	}
+	args := []interface{}{regionID}
+	filter, args := orderFilterClause(context, args)
+	query := `SELECT ` + orderColumns + ` FROM "orders" WHERE "regionID" = $1` + filter
 
-	err = tx.Commit()
+	orders, err := fetchOrders(query, args...)
 	if err != nil {
 		context.AbortWithError(500, err)
 		return
 	}
 
 	context.Header("Access-Control-Allow-Origin", "*")
-	context.Data(200, "application/json; charset=utf-8", response)
+	context.JSON(200, orders)
 }
 
 func getType(context *gin.Context) {
 	typeID := context.Param("typeID")
 
-	query := `SELECT "market" FROM "markets" WHERE "typeID" = $1`
-	tx, err := db.Begin()
-	if err != nil {
-		context.AbortWithError(500, err)
-		return
-	}
+	args := []interface{}{typeID}
+	filter, args := orderFilterClause(context, args)
+	query := `SELECT ` + orderColumns + ` FROM "orders" WHERE "typeID" = $1` + filter
 
-	rows, err := tx.Query(query, typeID)
-	if err != nil {
-		context.AbortWithError(500, err)
-		return
-	}
-
-	response, err := concatRowsToJSON(rows)
-	if err != nil {
-		context.AbortWithError(404, err)
-		return
-	}
-
-	err = tx.Commit()
+	orders, err := fetchOrders(query, args...)
 	if err != nil {
 		context.AbortWithError(500, err)
 		return
 	}
 
 	context.Header("Access-Control-Allow-Origin", "*")
-	context.Data(200, "application/json; charset=utf-8", response)
+	context.JSON(200, orders)
 }
 
 func getRegionType(context *gin.Context) {
 	regionID := context.Param("regionID")
 	typeID := context.Param("typeID")
 
-	query := `SELECT "market" FROM "markets" WHERE "regionID" = $1 AND "typeID" = $2`
-	tx, err := db.Begin()
-	if err != nil {
-		context.AbortWithError(500, err)
-		return
-	}
+	args := []interface{}{regionID, typeID}
+	filter, args := orderFilterClause(context, args)
+	query := `SELECT ` + orderColumns + ` FROM "orders" WHERE "regionID" = $1 AND "typeID" = $2` + filter
 
-	rows, err := tx.Query(query, regionID, typeID)
-	if err != nil {
-		context.AbortWithError(500, err)
-		return
-	}
-
-	response, err := concatRowsToJSON(rows)
-	if err != nil {
-		context.AbortWithError(404, err)
-		return
-	}
-
-	err = tx.Commit()
+	orders, err := fetchOrders(query, args...)
 	if err != nil {
 		context.AbortWithError(500, err)
 		return
 	}
 
 	context.Header("Access-Control-Allow-Origin", "*")
-	context.Data(200, "application/json; charset=utf-8", response)
+	context.JSON(200, orders)
 }
 
-func concatRowsToJSON(rows *sql.Rows) ([]byte, error) {
-	defer rows.Close()
-
-	response := []byte("[")
-	for rows.Next() {
-		var market []byte
-
-		err := rows.Scan(&market)
-		if err != nil {
-			return nil, err
-		}
+// orderFilterClause builds an additional "AND ..." SQL clause from the
+// optional buy_sell/station_id/min_price/max_price query params, appending
+// their values to args so the returned clause's placeholders line up.
+func orderFilterClause(context *gin.Context, args []interface{}) (string, []interface{}) {
+	var clauses []string
+
+	switch context.Query("buy_sell") {
+	case "buy":
+		args = append(args, true)
+		clauses = append(clauses, fmt.Sprintf(`"isBuyOrder" = $%d`, len(args)))
+	case "sell":
+		args = append(args, false)
+		clauses = append(clauses, fmt.Sprintf(`"isBuyOrder" = $%d`, len(args)))
+	}
 
-		var decompressedMarket []byte
-		decompressedMarket, err = snappy.Decode(decompressedMarket, market)
-		if err != nil {
-			return nil, err
-		}
+	if stationID := context.Query("station_id"); stationID != "" {
+		args = append(args, stationID)
+		clauses = append(clauses, fmt.Sprintf(`"stationID" = $%d`, len(args)))
+	}
 
-		orders, _, _, err := jsonparser.Get(decompressedMarket, "orders")
-		if err != nil {
-			return nil, err
-		}
+	if minPrice := context.Query("min_price"); minPrice != "" {
+		args = append(args, minPrice)
+		clauses = append(clauses, fmt.Sprintf(`"price" >= $%d`, len(args)))
+	}
 
-		response = append(response, orders[1:len(orders)-1]...)
-		response = append(response, ","...)
+	if maxPrice := context.Query("max_price"); maxPrice != "" {
+		args = append(args, maxPrice)
+		clauses = append(clauses, fmt.Sprintf(`"price" <= $%d`, len(args)))
 	}
 
-	if len(response) > 1 {
-		response = response[:len(response)-1]
+	if len(clauses) == 0 {
+		return "", args
 	}
-	response = append(response, "]"...)
 
-	return response, nil
+	return " AND " + strings.Join(clauses, " AND "), args
 }
 
 // Load configuration from environment
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+)
+
+// Order is a single market order, mirroring the "orders" table columns.
+type Order struct {
+	OrderID      int64   `json:"orderID"`
+	RegionID     int64   `json:"regionID"`
+	TypeID       int64   `json:"typeID"`
+	StationID    int64   `json:"stationID"`
+	IsBuyOrder   bool    `json:"isBuyOrder"`
+	Price        float64 `json:"price"`
+	VolumeRemain int64   `json:"volumeRemain"`
+	VolumeTotal  int64   `json:"volumeTotal"`
+	MinVolume    int64   `json:"minVolume"`
+	Duration     int64   `json:"duration"`
+	Issued       string  `json:"issued"`
+	Range        string  `json:"range"`
+}
+
+// parseOrdersJSON parses the "orders" array of an NSQ message body into
+// individual Order structs, tagging each with the regionID/typeID the
+// snapshot was published under.
+func parseOrdersJSON(body []byte, regionID, typeID int64) ([]Order, error) {
+	ordersJSON, _, _, err := jsonparser.Get(body, "orders")
+	if err != nil {
+		return nil, err
+	}
+
+	var orders []Order
+	var iterErr error
+	jsonparser.ArrayEach(ordersJSON, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		if err != nil || iterErr != nil {
+			return
+		}
+
+		order, parseErr := parseOrder(value, regionID, typeID)
+		if parseErr != nil {
+			iterErr = parseErr
+			return
+		}
+
+		orders = append(orders, order)
+	})
+	if iterErr != nil {
+		return nil, iterErr
+	}
+
+	return orders, nil
+}
+
+// parseOrder parses a single order object from the NSQ feed.
+func parseOrder(raw []byte, regionID, typeID int64) (Order, error) {
+	orderID, err := jsonparser.GetInt(raw, "orderID")
+	if err != nil {
+		return Order{}, err
+	}
+
+	stationID, err := jsonparser.GetInt(raw, "stationID")
+	if err != nil {
+		return Order{}, err
+	}
+
+	isBuyOrder, err := jsonparser.GetBoolean(raw, "isBuyOrder")
+	if err != nil {
+		return Order{}, err
+	}
+
+	price, err := jsonparser.GetFloat(raw, "price")
+	if err != nil {
+		return Order{}, err
+	}
+
+	volumeRemain, err := jsonparser.GetInt(raw, "volumeRemain")
+	if err != nil {
+		return Order{}, err
+	}
+
+	volumeTotal, err := jsonparser.GetInt(raw, "volumeTotal")
+	if err != nil {
+		return Order{}, err
+	}
+
+	minVolume, err := jsonparser.GetInt(raw, "minVolume")
+	if err != nil {
+		return Order{}, err
+	}
+
+	duration, err := jsonparser.GetInt(raw, "duration")
+	if err != nil {
+		return Order{}, err
+	}
+
+	issued, err := jsonparser.GetString(raw, "issued")
+	if err != nil {
+		return Order{}, err
+	}
+
+	orderRange, err := jsonparser.GetString(raw, "range")
+	if err != nil {
+		return Order{}, err
+	}
+
+	return Order{
+		OrderID:      orderID,
+		RegionID:     regionID,
+		TypeID:       typeID,
+		StationID:    stationID,
+		IsBuyOrder:   isBuyOrder,
+		Price:        price,
+		VolumeRemain: volumeRemain,
+		VolumeTotal:  volumeTotal,
+		MinVolume:    minVolume,
+		Duration:     duration,
+		Issued:       issued,
+		Range:        orderRange,
+	}, nil
+}
+
+// columnsPerOrder is the number of bind parameters upsertOrderBatch uses
+// per order.
+const columnsPerOrder = 13
+
+// postgresMaxBindParams is PostgreSQL's hard ceiling on bind parameters
+// per statement (2^16 - 1).
+const postgresMaxBindParams = 65535
+
+// upsertBatchSize caps how many orders go into a single multi-row INSERT,
+// well under postgresMaxBindParams/columnsPerOrder (~5041) so a single
+// snapshot for a busy market (Jita Tritanium, PLEX, ...) can't blow the
+// limit and permanently fail to persist.
+const upsertBatchSize = 1000
+
+// upsertOrders batches orders into one or more multi-row
+// INSERT ... ON CONFLICT DO UPDATE statements within tx, stamping every
+// row with updatedAt so the reaper can later tell which orders are stale.
+func upsertOrders(tx *sql.Tx, orders []Order, updatedAt time.Time) error {
+	for start := 0; start < len(orders); start += upsertBatchSize {
+		end := start + upsertBatchSize
+		if end > len(orders) {
+			end = len(orders)
+		}
+
+		if err := upsertOrderBatch(tx, orders[start:end], updatedAt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func upsertOrderBatch(tx *sql.Tx, orders []Order, updatedAt time.Time) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	values := make([]string, len(orders))
+	args := make([]interface{}, 0, len(orders)*columnsPerOrder)
+	for i, order := range orders {
+		base := i*columnsPerOrder + 1
+		placeholders := make([]string, columnsPerOrder)
+		for j := 0; j < columnsPerOrder; j++ {
+			placeholders[j] = fmt.Sprintf("$%d", base+j)
+		}
+		values[i] = "(" + strings.Join(placeholders, ", ") + ")"
+
+		args = append(args,
+			order.OrderID, order.RegionID, order.TypeID, order.StationID,
+			order.IsBuyOrder, order.Price, order.VolumeRemain, order.VolumeTotal,
+			order.MinVolume, order.Duration, order.Issued, order.Range, updatedAt,
+		)
+	}
+
+	query := `
+		INSERT INTO "orders" (
+			"orderID", "regionID", "typeID", "stationID", "isBuyOrder",
+			"price", "volumeRemain", "volumeTotal", "minVolume", "duration",
+			"issued", "range", "updatedAt"
+		) VALUES ` + strings.Join(values, ", ") + `
+		ON CONFLICT ("orderID") DO UPDATE SET
+			"stationID" = EXCLUDED."stationID",
+			"isBuyOrder" = EXCLUDED."isBuyOrder",
+			"price" = EXCLUDED."price",
+			"volumeRemain" = EXCLUDED."volumeRemain",
+			"volumeTotal" = EXCLUDED."volumeTotal",
+			"minVolume" = EXCLUDED."minVolume",
+			"duration" = EXCLUDED."duration",
+			"issued" = EXCLUDED."issued",
+			"range" = EXCLUDED."range",
+			"updatedAt" = EXCLUDED."updatedAt"`
+
+	_, err := tx.Exec(query, args...)
+	return err
+}
+
+// fetchOrders runs query against the orders table and scans the matched
+// rows directly into Order structs.
+func fetchOrders(query string, args ...interface{}) ([]Order, error) {
+	start := time.Now()
+	defer func() {
+		dbTransactionDuration.WithLabelValues("select").Observe(time.Since(start).Seconds())
+	}()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		var order Order
+		err := rows.Scan(
+			&order.OrderID, &order.RegionID, &order.TypeID, &order.StationID,
+			&order.IsBuyOrder, &order.Price, &order.VolumeRemain, &order.VolumeTotal,
+			&order.MinVolume, &order.Duration, &order.Issued, &order.Range,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		orders = append(orders, order)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return orders, tx.Commit()
+}
+
+const orderColumns = `"orderID", "regionID", "typeID", "stationID", "isBuyOrder", "price", "volumeRemain", "volumeTotal", "minVolume", "duration", "issued", "range"`
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// reapInterval is how often stale orders are swept from the database.
+const reapInterval = 5 * time.Minute
+
+type snapshotKey struct {
+	regionID int64
+	typeID   int64
+}
+
+// snapshotTracker remembers when each (regionID, typeID) pair last had a
+// full snapshot committed, so the reaper knows which orders have fallen
+// out of the latest snapshot and can be deleted.
+type snapshotTracker struct {
+	mu       sync.Mutex
+	lastSeen map[snapshotKey]time.Time
+}
+
+var snapshots = &snapshotTracker{lastSeen: make(map[snapshotKey]time.Time)}
+
+func (t *snapshotTracker) record(regionID, typeID int64, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastSeen[snapshotKey{regionID, typeID}] = at
+}
+
+func (t *snapshotTracker) snapshot() map[snapshotKey]time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	keys := make(map[snapshotKey]time.Time, len(t.lastSeen))
+	for key, at := range t.lastSeen {
+		keys[key] = at
+	}
+	return keys
+}
+
+// startReaper periodically deletes orders that weren't refreshed by the
+// most recent snapshot for their (regionID, typeID) pair.
+func startReaper() {
+	go func() {
+		ticker := time.NewTicker(reapInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			for key, lastSeen := range snapshots.snapshot() {
+				deleted, err := reapStaleOrders(key.regionID, key.typeID, lastSeen)
+				if err != nil {
+					logrus.Warnf("Error reaping stale orders for region %d, type %d: %s", key.regionID, key.typeID, err.Error())
+					continue
+				}
+				if deleted > 0 {
+					logrus.Debugf("Reaped %d stale orders for region %d, type %d", deleted, key.regionID, key.typeID)
+				}
+			}
+		}
+	}()
+}
+
+// reapStaleOrders deletes orders for (regionID, typeID) that are older
+// than the last snapshot commit, i.e. orders that disappeared from the
+// market without an explicit cancel/fill notification.
+func reapStaleOrders(regionID, typeID int64, lastSeen time.Time) (int64, error) {
+	query := `DELETE FROM "orders" WHERE "regionID" = $1 AND "typeID" = $2 AND "updatedAt" < $3`
+	result, err := db.Exec(query, regionID, typeID, lastSeen)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
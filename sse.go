@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// heartbeatInterval keeps intermediate proxies from timing out an idle
+// stream connection.
+const heartbeatInterval = 15 * time.Second
+
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// streamOrders subscribes the caller to order update events, optionally
+// filtered by regionID/typeID. It serves Server-Sent Events by default and
+// upgrades to a WebSocket when the client asks for one.
+func streamOrders(context *gin.Context) {
+	regionID, typeID, err := parseStreamFilter(context)
+	if err != nil {
+		context.AbortWithError(400, err)
+		return
+	}
+
+	sub := streamHub.subscribe(regionID, typeID)
+	defer streamHub.unsubscribe(sub.id)
+
+	if context.IsWebsocket() {
+		serveWebSocketStream(context, sub)
+		return
+	}
+
+	serveSSEStream(context, sub)
+}
+
+func parseStreamFilter(context *gin.Context) (*int64, *int64, error) {
+	var regionID, typeID *int64
+
+	if raw := context.Query("regionID"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		regionID = &parsed
+	}
+
+	if raw := context.Query("typeID"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		typeID = &parsed
+	}
+
+	return regionID, typeID, nil
+}
+
+func serveSSEStream(context *gin.Context, sub *subscriber) {
+	context.Header("Content-Type", "text/event-stream")
+	context.Header("Cache-Control", "no-cache")
+	context.Header("Connection", "keep-alive")
+	context.Header("Access-Control-Allow-Origin", "*")
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	context.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				return false
+			}
+
+			payload, err := json.Marshal(event)
+			if err != nil {
+				return false
+			}
+
+			fmt.Fprintf(w, "data: %s\n\n", payload)
+			return true
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			return true
+		case <-context.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+func serveWebSocketStream(context *gin.Context, sub *subscriber) {
+	conn, err := wsUpgrader.Upgrade(context.Writer, context.Request, nil)
+	if err != nil {
+		logrus.Warnf("Error upgrading stream to WebSocket: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-context.Request.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Event is published to stream subscribers whenever handleMessage commits
+// a rowset for their (regionID, typeID) key.
+type Event struct {
+	RegionID   int64     `json:"regionID"`
+	TypeID     int64     `json:"typeID"`
+	OrderCount int       `json:"orderCount"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// subscriberBacklog bounds how many unread events a subscriber can fall
+// behind by before an individual event is dropped.
+const subscriberBacklog = 16
+
+// maxConsecutiveDrops is how many back-to-back full-buffer drops a
+// subscriber tolerates before it's unsubscribed and disconnected outright,
+// rather than being left registered to receive an arbitrary subset of
+// future events forever.
+const maxConsecutiveDrops = 5
+
+type subscriber struct {
+	id       uint64
+	regionID *int64
+	typeID   *int64
+	events   chan Event
+	drops    int
+}
+
+func (s *subscriber) matches(event Event) bool {
+	if s.regionID != nil && *s.regionID != event.RegionID {
+		return false
+	}
+	if s.typeID != nil && *s.typeID != event.TypeID {
+		return false
+	}
+	return true
+}
+
+// hub is an in-process pub/sub fan-out for order update events. It avoids
+// pulling in a message broker just to notify HTTP clients of changes we
+// already have in memory.
+type hub struct {
+	mu          sync.Mutex
+	nextID      uint64
+	subscribers map[uint64]*subscriber
+}
+
+var streamHub = &hub{subscribers: make(map[uint64]*subscriber)}
+
+// subscribe registers a new subscriber filtered by regionID/typeID (either
+// may be nil to mean "any"). Callers must call unsubscribe when done.
+func (h *hub) subscribe(regionID, typeID *int64) *subscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	sub := &subscriber{
+		id:       h.nextID,
+		regionID: regionID,
+		typeID:   typeID,
+		events:   make(chan Event, subscriberBacklog),
+	}
+	h.subscribers[sub.id] = sub
+	return sub
+}
+
+func (h *hub) unsubscribe(id uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, id)
+}
+
+// publish fans event out to every matching subscriber without ever
+// blocking the caller, which is the NSQ handler goroutine: an event is
+// dropped for any subscriber whose buffer is currently full, and a
+// subscriber that drops maxConsecutiveDrops events in a row is assumed
+// stuck and is unsubscribed and disconnected outright, rather than being
+// left registered to receive an arbitrary subset of future events.
+func (h *hub) publish(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, sub := range h.subscribers {
+		if !sub.matches(event) {
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+			sub.drops = 0
+		default:
+			sub.drops++
+			if sub.drops >= maxConsecutiveDrops {
+				delete(h.subscribers, sub.id)
+				close(sub.events)
+			}
+		}
+	}
+}
+
+// count returns the number of live subscribers, used by the metrics endpoint.
+func (h *hub) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}